@@ -0,0 +1,224 @@
+package httpproxy
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// privateRanges are the address blocks a destination must not resolve
+// into unless an explicit hostRule CIDR literal allows it. This closes
+// the SSRF hole where a permissive host pattern (e.g.
+// "*.compute.amazonaws.com") could otherwise be used to reach internal
+// or metadata-adjacent addresses.
+var privateRanges = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// hostRule is a single compiled validHosts entry. Entries look like:
+//
+//	example.com                     exact match
+//	*.example.com                   single subdomain label
+//	**.example.com                  any subdomain depth
+//	!evil.example.com                explicit deny, evaluated before allow
+//	api.github.com/repos/            host with a required path prefix
+//	10.0.0.0/8                       IP/CIDR literal
+//	*.corp.example=namespace:secret  host with a TLS profile secret ref
+type hostRule struct {
+	deny       bool
+	anyDepth   bool
+	wildcard   bool
+	host       string
+	pathPrefix string
+	cidr       *net.IPNet
+	secretRef  string
+}
+
+func (r *hostRule) matchesHost(host string) bool {
+	if r.cidr != nil {
+		return false
+	}
+	if r.anyDepth {
+		return host == r.host || strings.HasSuffix(host, "."+r.host)
+	}
+	if r.wildcard {
+		if !strings.HasSuffix(host, "."+r.host) {
+			return false
+		}
+		label := strings.TrimSuffix(host, "."+r.host)
+		return !strings.Contains(label, ".")
+	}
+	return host == r.host
+}
+
+func compileHostRule(entry string) hostRule {
+	rule := hostRule{}
+
+	if strings.HasPrefix(entry, "!") {
+		rule.deny = true
+		entry = entry[1:]
+	}
+
+	if index := strings.Index(entry, "="); index != -1 {
+		rule.secretRef = entry[index+1:]
+		entry = entry[:index]
+	}
+
+	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+		rule.cidr = ipNet
+		return rule
+	}
+
+	host := entry
+	if index := strings.Index(entry, "/"); index != -1 {
+		host = entry[:index]
+		rule.pathPrefix = entry[index:]
+	}
+
+	switch {
+	case strings.HasPrefix(host, "**."):
+		rule.anyDepth = true
+		rule.host = strings.TrimPrefix(host, "**.")
+	case strings.HasPrefix(host, "*"):
+		rule.wildcard = true
+		rule.host = strings.TrimPrefix(host, "*.")
+		// Before anyDepth ("**.") existed, a single "*." entry matched any
+		// subdomain depth; it now matches exactly one label. Existing
+		// validHosts config carried over from before this change silently
+		// stops matching multi-level subdomains it used to allow -- warn
+		// whenever such an entry is compiled so that's visible instead of
+		// showing up as a mysterious "invalid host" later. Entries that need the old
+		// behavior should be rewritten to "**.".
+		logrus.Warnf("httpproxy: validHosts entry %q now only matches a single subdomain label; use \"**.%s\" to match any depth as it did before", host, rule.host)
+	default:
+		rule.host = host
+	}
+
+	return rule
+}
+
+// HostPolicy is a compiled snapshot of validHosts entries: host match
+// rules (with explicit deny taking precedence over allow), per-host path
+// prefix restrictions, per-host TLS profile references, and CIDR
+// literals used to permit otherwise-blocked private destination
+// addresses.
+type HostPolicy struct {
+	rules []hostRule
+}
+
+func CompileHostPolicy(entries []string) *HostPolicy {
+	policy := &HostPolicy{rules: make([]hostRule, 0, len(entries))}
+	for _, entry := range entries {
+		if entry == "" {
+			continue
+		}
+		policy.rules = append(policy.rules, compileHostRule(entry))
+	}
+	return policy
+}
+
+// Allowed reports whether destURL may be proxied to under this policy,
+// and the TLS profile secret ref (if any) configured for the matching
+// host rule. Deny rules are evaluated before allow rules regardless of
+// list order.
+func (p *HostPolicy) Allowed(destURL *url.URL) (bool, string) {
+	host := destURL.Hostname()
+
+	for _, rule := range p.rules {
+		if !rule.deny || rule.cidr != nil {
+			continue
+		}
+		if rule.matchesHost(host) {
+			return false, ""
+		}
+	}
+
+	for _, rule := range p.rules {
+		if rule.deny || rule.cidr != nil {
+			continue
+		}
+		if !rule.matchesHost(host) {
+			continue
+		}
+		if rule.pathPrefix != "" && !strings.HasPrefix(destURL.Path, rule.pathPrefix) {
+			continue
+		}
+		return true, rule.secretRef
+	}
+
+	return false, ""
+}
+
+// AllowedAddr reports whether ip may be used to reach a proxied
+// destination. Addresses outside privateRanges are always allowed; those
+// inside require an explicit CIDR literal in the policy that contains
+// the address.
+func (p *HostPolicy) AllowedAddr(ip net.IP) bool {
+	private := false
+	for _, r := range privateRanges {
+		if r.Contains(ip) {
+			private = true
+			break
+		}
+	}
+	if !private {
+		return true
+	}
+
+	for _, rule := range p.rules {
+		if rule.cidr == nil || rule.deny {
+			continue
+		}
+		if rule.cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostPolicyCache compiles a HostPolicy once per distinct validHosts
+// snapshot returned by the Supplier, so repeated requests don't re-parse
+// the same rules.
+type hostPolicyCache struct {
+	mu     sync.Mutex
+	key    string
+	policy *HostPolicy
+}
+
+func (c *hostPolicyCache) get(entries []string) *HostPolicy {
+	key := strings.Join(entries, "\x00")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.policy != nil && c.key == key {
+		return c.policy
+	}
+
+	c.policy = CompileHostPolicy(entries)
+	c.key = key
+	return c.policy
+}
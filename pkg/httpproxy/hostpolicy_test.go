@@ -0,0 +1,170 @@
+package httpproxy
+
+import (
+	"net"
+	"net/url"
+	"testing"
+)
+
+func mustURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", raw, err)
+	}
+	return u
+}
+
+func TestHostPolicyAllowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		entries    []string
+		url        string
+		wantOK     bool
+		wantSecret string
+	}{
+		{
+			name:    "exact match",
+			entries: []string{"example.com"},
+			url:     "https://example.com/foo",
+			wantOK:  true,
+		},
+		{
+			name:    "exact match rejects other host",
+			entries: []string{"example.com"},
+			url:     "https://evil.example.com/foo",
+			wantOK:  false,
+		},
+		{
+			name:    "single-label wildcard matches one subdomain",
+			entries: []string{"*.example.com"},
+			url:     "https://api.example.com/foo",
+			wantOK:  true,
+		},
+		{
+			name:    "single-label wildcard rejects two levels deep",
+			entries: []string{"*.example.com"},
+			url:     "https://a.b.example.com/foo",
+			wantOK:  false,
+		},
+		{
+			name:    "any-depth wildcard matches arbitrary depth",
+			entries: []string{"**.example.com"},
+			url:     "https://a.b.c.example.com/foo",
+			wantOK:  true,
+		},
+		{
+			name:    "any-depth wildcard matches the bare domain too",
+			entries: []string{"**.example.com"},
+			url:     "https://example.com/foo",
+			wantOK:  true,
+		},
+		{
+			name:    "deny rule wins over a broader allow",
+			entries: []string{"**.example.com", "!evil.example.com"},
+			url:     "https://evil.example.com/foo",
+			wantOK:  false,
+		},
+		{
+			name:    "deny rule order in the list doesn't matter",
+			entries: []string{"!evil.example.com", "**.example.com"},
+			url:     "https://evil.example.com/foo",
+			wantOK:  false,
+		},
+		{
+			name:    "deny rule doesn't block unrelated hosts",
+			entries: []string{"**.example.com", "!evil.example.com"},
+			url:     "https://good.example.com/foo",
+			wantOK:  true,
+		},
+		{
+			name:    "path prefix restriction allows matching path",
+			entries: []string{"api.github.com/repos/"},
+			url:     "https://api.github.com/repos/rancher/rancher",
+			wantOK:  true,
+		},
+		{
+			name:    "path prefix restriction rejects other paths",
+			entries: []string{"api.github.com/repos/"},
+			url:     "https://api.github.com/users/octocat",
+			wantOK:  false,
+		},
+		{
+			name:       "secret ref is returned for the matching rule",
+			entries:    []string{"*.corp.example=cattle-system:corp-ca"},
+			url:        "https://vault.corp.example/v1/secret",
+			wantOK:     true,
+			wantSecret: "cattle-system:corp-ca",
+		},
+		{
+			name:    "CIDR literal entries never match as hosts",
+			entries: []string{"10.0.0.0/8"},
+			url:     "https://10.0.0.0/8",
+			wantOK:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := CompileHostPolicy(tt.entries)
+			ok, secretRef := policy.Allowed(mustURL(t, tt.url))
+			if ok != tt.wantOK {
+				t.Fatalf("Allowed() = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && secretRef != tt.wantSecret {
+				t.Fatalf("secretRef = %q, want %q", secretRef, tt.wantSecret)
+			}
+		})
+	}
+}
+
+func TestHostPolicyAllowedAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		addr    string
+		want    bool
+	}{
+		{
+			name: "public address is allowed with no CIDR rules",
+			addr: "93.184.216.34",
+			want: true,
+		},
+		{
+			name: "RFC1918 address is denied with no explicit allow",
+			addr: "10.1.2.3",
+			want: false,
+		},
+		{
+			name:    "RFC1918 address is allowed when explicitly whitelisted",
+			entries: []string{"10.0.0.0/8"},
+			addr:    "10.1.2.3",
+			want:    true,
+		},
+		{
+			name:    "RFC1918 address outside the whitelisted range stays denied",
+			entries: []string{"10.1.0.0/16"},
+			addr:    "10.2.0.5",
+			want:    false,
+		},
+		{
+			name: "loopback is denied by default",
+			addr: "127.0.0.1",
+			want: false,
+		},
+		{
+			name: "link-local is denied by default",
+			addr: "169.254.169.254",
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := CompileHostPolicy(tt.entries)
+			if got := policy.AllowedAddr(net.ParseIP(tt.addr)); got != tt.want {
+				t.Fatalf("AllowedAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package httpproxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditMiddleware records a structured line per proxied request so
+// operators can see who called out through the proxy, to where, and with
+// what result -- the plain "Failed to proxy" log line it replaces only
+// fired on error and threw away everything else.
+type auditMiddleware struct {
+	noopMiddleware
+
+	// user extracts the authenticated caller from the inbound request,
+	// e.g. from the Rancher auth context. Defaults to RemoteAddr.
+	user func(req *http.Request) string
+}
+
+// WithAuditLog logs (user, method, destHost, path, status, bytes) for
+// every proxied request. userFunc may be nil, in which case the caller's
+// remote address is logged.
+func WithAuditLog(userFunc func(req *http.Request) string) Option {
+	if userFunc == nil {
+		userFunc = func(req *http.Request) string { return req.RemoteAddr }
+	}
+	return WithMiddleware(&auditMiddleware{user: userFunc})
+}
+
+func (m *auditMiddleware) Done(req *http.Request, status int, bytes int64, elapsed time.Duration) {
+	destHost, destPath := Destination(req)
+	logrus.WithFields(logrus.Fields{
+		"user":     m.user(req),
+		"method":   req.Method,
+		"destHost": destHost,
+		"path":     destPath,
+		"status":   status,
+		"bytes":    bytes,
+		"elapsed":  elapsed,
+	}).Info("httpproxy request")
+}
@@ -0,0 +1,104 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterTTL is how long an idle per-key limiter is kept around before
+// sweepLocked evicts it. Rate limit keys are commonly per-destination-host
+// plus caller, and callers/hosts come and go, so without eviction the
+// limiters map grows without bound over the life of the process.
+const limiterTTL = 10 * time.Minute
+
+// sweepInterval is how often, in number of requests handled, the eviction
+// sweep runs.
+const sweepInterval = 1000
+
+// rateLimitMiddleware enforces a token-bucket limit per key, where the
+// key is normally the destination host plus the authenticated caller, so
+// one runaway integration can't starve proxied calls to other upstreams.
+type rateLimitMiddleware struct {
+	noopMiddleware
+
+	limit rate.Limit
+	burst int
+
+	// key derives the rate-limit bucket from the resolved request, e.g.
+	// destURL.Host plus the Rancher-authenticated user. Runs in After, so
+	// the request has already been resolved to its destination.
+	key func(req *http.Request) string
+
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+	calls    int
+}
+
+// limiterEntry pairs a limiter with the last time it was used, so an idle
+// entry can be swept out of the map.
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// WithRateLimit limits proxied requests to limit-per-second per key, with
+// bursts up to burst. keyFunc may be nil, in which case requests are
+// limited per destination host only.
+func WithRateLimit(limit rate.Limit, burst int, keyFunc func(req *http.Request) string) Option {
+	if keyFunc == nil {
+		keyFunc = defaultRateLimitKey
+	}
+	return WithMiddleware(&rateLimitMiddleware{
+		limit:    limit,
+		burst:    burst,
+		key:      keyFunc,
+		limiters: map[string]*limiterEntry{},
+	})
+}
+
+func (m *rateLimitMiddleware) After(req *http.Request) error {
+	key := m.key(req)
+	now := time.Now()
+
+	m.mu.Lock()
+	entry, ok := m.limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(m.limit, m.burst)}
+		m.limiters[key] = entry
+	}
+	entry.lastUsed = now
+
+	m.calls++
+	if m.calls >= sweepInterval {
+		m.calls = 0
+		m.sweepLocked(now)
+	}
+	m.mu.Unlock()
+
+	if !entry.limiter.Allow() {
+		return fmt.Errorf("rate limit exceeded for %s", key)
+	}
+	return nil
+}
+
+// sweepLocked evicts limiters that haven't been used in over limiterTTL.
+// Callers must hold m.mu.
+func (m *rateLimitMiddleware) sweepLocked(now time.Time) {
+	for key, entry := range m.limiters {
+		if now.Sub(entry.lastUsed) > limiterTTL {
+			delete(m.limiters, key)
+		}
+	}
+}
+
+// defaultRateLimitKey is a best-effort fallback key for callers that
+// don't need per-user limits: the request has already been resolved to
+// its destination by the time After runs, so req.URL.Host is the
+// upstream, not the caller-supplied prefix path.
+func defaultRateLimitKey(req *http.Request) string {
+	return req.URL.Host
+}
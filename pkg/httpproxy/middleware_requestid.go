@@ -0,0 +1,37 @@
+package httpproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+// requestIDMiddleware generates a request ID for inbound requests that
+// don't already carry one, and propagates it to the outbound request so
+// it shows up in both Rancher's and the upstream's logs.
+type requestIDMiddleware struct {
+	noopMiddleware
+}
+
+// WithRequestID injects an X-Request-Id header on every proxied request,
+// generating one if the caller didn't already set it.
+func WithRequestID() Option {
+	return WithMiddleware(&requestIDMiddleware{})
+}
+
+func (m *requestIDMiddleware) Before(req *http.Request) error {
+	if req.Header.Get(RequestIDHeader) == "" {
+		req.Header.Set(RequestIDHeader, newRequestID())
+	}
+	return nil
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
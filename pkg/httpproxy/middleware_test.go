@@ -0,0 +1,142 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// recordingMiddleware appends to a shared log on every hook, so tests can
+// assert both that a hook ran and the order multiple middlewares ran in.
+type recordingMiddleware struct {
+	name      string
+	log       *[]string
+	beforeErr error
+	afterErr  error
+}
+
+func (m *recordingMiddleware) Before(req *http.Request) error {
+	*m.log = append(*m.log, m.name+":Before")
+	return m.beforeErr
+}
+
+func (m *recordingMiddleware) After(req *http.Request) error {
+	*m.log = append(*m.log, m.name+":After")
+	return m.afterErr
+}
+
+func (m *recordingMiddleware) Done(req *http.Request, status int, bytes int64, elapsed time.Duration) {
+	*m.log = append(*m.log, m.name+":Done")
+}
+
+// testProxy builds a minimal *proxy that will successfully resolve
+// "example.com" through proxy() -- validHosts allows it and resolveHost
+// is stubbed to a public address -- so tests can focus on
+// middlewareHandler's Before/After/Done wiring rather than host policy
+// or DNS.
+func testProxy(middlewares ...Middleware) *proxy {
+	return &proxy{
+		prefix:             "/proxy/",
+		validHostsSupplier: func() []string { return []string{"example.com"} },
+		resolveHost: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("93.184.216.34")}, nil
+		},
+		middlewares: middlewares,
+	}
+}
+
+func TestMiddlewareHandlerBeforeErrorShortCircuits(t *testing.T) {
+	var log []string
+	nextCalled := false
+	h := &middlewareHandler{
+		proxy: testProxy(&recordingMiddleware{name: "a", log: &log, beforeErr: fmt.Errorf("denied")}),
+		next:  http.HandlerFunc(func(http.ResponseWriter, *http.Request) { nextCalled = true }),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy/example.com/foo", nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusForbidden)
+	}
+	if nextCalled {
+		t.Fatal("next was invoked after Before rejected the request")
+	}
+	if got, want := log, []string{"a:Before"}; !equalLogs(got, want) {
+		t.Fatalf("hooks run = %v, want %v (After/Done must not run once Before rejects)", got, want)
+	}
+}
+
+func TestMiddlewareHandlerAfterErrorShortCircuits(t *testing.T) {
+	var log []string
+	nextCalled := false
+	h := &middlewareHandler{
+		proxy: testProxy(&recordingMiddleware{name: "a", log: &log, afterErr: fmt.Errorf("rejected after resolution")}),
+		next:  http.HandlerFunc(func(http.ResponseWriter, *http.Request) { nextCalled = true }),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy/example.com/foo", nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusBadGateway)
+	}
+	if nextCalled {
+		t.Fatal("next was invoked after After rejected the request")
+	}
+	if got, want := log, []string{"a:Before", "a:After"}; !equalLogs(got, want) {
+		t.Fatalf("hooks run = %v, want %v (Done must not run once After rejects)", got, want)
+	}
+}
+
+func TestMiddlewareHandlerSuccessRunsDoneInReverseOrder(t *testing.T) {
+	var log []string
+	first := &recordingMiddleware{name: "first", log: &log}
+	second := &recordingMiddleware{name: "second", log: &log}
+
+	nextCalled := false
+	h := &middlewareHandler{
+		proxy: testProxy(first, second),
+		next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			nextCalled = true
+			rw.WriteHeader(http.StatusOK)
+		}),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy/example.com/foo", nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if !nextCalled {
+		t.Fatal("next was never invoked for a request that passed Before/After")
+	}
+
+	want := []string{
+		"first:Before", "second:Before",
+		"first:After", "second:After",
+		"second:Done", "first:Done",
+	}
+	if !equalLogs(log, want) {
+		t.Fatalf("hooks run = %v, want %v", log, want)
+	}
+}
+
+func equalLogs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,289 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/rancher/types/apis/core/v1"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	oidcDataIssuer       = "issuer"
+	oidcDataClientID     = "client_id"
+	oidcDataClientSecret = "client_secret"
+	oidcDataRefreshToken = "refresh_token"
+	oidcDataAccessToken  = "access_token"
+	oidcDataExpiry       = "expiry"
+	oidcDataRefreshSkew  = "refresh_skew"
+
+	defaultTokenRefreshSkew = 60 * time.Second
+)
+
+// oidcSigner treats the referenced Secret as an OAuth2/OIDC client and
+// keeps its cached access token fresh, refreshing against the issuer's
+// token endpoint when the token is within the configured skew of expiry.
+// The skew defaults to defaultTokenRefreshSkew but can be overridden per
+// credential via the refresh_skew secret data key (e.g. "2m").
+type oidcSigner struct {
+	// tokens is the owning proxy's token cache. A fresh oidcSigner is
+	// built per sign() call (see newSigner), but tokens is shared for
+	// the life of that proxy so refreshes are still cached and
+	// single-flighted across calls.
+	tokens *oidcTokenCache
+}
+
+// refreshedToken is an in-memory, successfully-refreshed token kept
+// independent of whether it was persisted back to the Secret.
+type refreshedToken struct {
+	token  string
+	expiry time.Time
+}
+
+// oidcTokenCacheTTL is how long a refreshed token is kept in an
+// oidcTokenCache after its last use before it's swept out, mirroring
+// rateLimitMiddleware's limiterTTL: a long-running proxy otherwise
+// accumulates one entry per distinct OIDC credential Secret it has ever
+// signed for, forever.
+const oidcTokenCacheTTL = 10 * time.Minute
+
+// oidcTokenCacheSweepInterval is how often, in number of refreshes, an
+// oidcTokenCache sweeps for expired entries.
+const oidcTokenCacheSweepInterval = 1000
+
+// oidcTokenCache caches refreshed access tokens and single-flights
+// concurrent refreshes, keyed by "namespace/name". It is owned by a
+// single *proxy (and therefore a single credentials client/cluster): two
+// proxies fronting different clusters must not share a cache, since
+// their OIDC credential Secrets could plausibly share a namespace/name
+// while pointing at entirely different issuers, which would otherwise
+// leak one cluster's bearer token into requests bound for the other.
+type oidcTokenCache struct {
+	group singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]*oidcTokenCacheEntry
+	calls   int
+}
+
+type oidcTokenCacheEntry struct {
+	token    refreshedToken
+	lastUsed time.Time
+}
+
+func newOIDCTokenCache() *oidcTokenCache {
+	return &oidcTokenCache{entries: map[string]*oidcTokenCacheEntry{}}
+}
+
+func (c *oidcTokenCache) load(key string) (refreshedToken, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return refreshedToken{}, false
+	}
+	entry.lastUsed = time.Now()
+	return entry.token, true
+}
+
+func (c *oidcTokenCache) store(key string, token refreshedToken) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = &oidcTokenCacheEntry{token: token, lastUsed: now}
+
+	c.calls++
+	if c.calls >= oidcTokenCacheSweepInterval {
+		c.calls = 0
+		c.sweepLocked(now)
+	}
+}
+
+// sweepLocked evicts entries that haven't been used in over
+// oidcTokenCacheTTL. Callers must hold c.mu.
+func (c *oidcTokenCache) sweepLocked(now time.Time) {
+	for key, entry := range c.entries {
+		if now.Sub(entry.lastUsed) > oidcTokenCacheTTL {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (o *oidcSigner) sign(req *http.Request, credentials v1.SecretInterface, cAuth string) error {
+	namespace, name, _, err := splitCattleAuth(cAuth)
+	if err != nil {
+		return err
+	}
+
+	secret, err := credentials.GetNamespaced(namespace, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("looking up OIDC credential %s/%s: %v", namespace, name, err)
+	}
+
+	token, err := o.tokens.tokenFor(namespace, name, secret, credentials)
+	if err != nil {
+		if fallback := string(secret.Data[oidcDataAccessToken]); fallback != "" {
+			logrus.Errorf("httpproxy: OIDC refresh failed for %s/%s, falling back to last known token: %v", namespace, name, err)
+			req.Header.Set(AuthHeader, "Bearer "+fallback)
+			return nil
+		}
+		return err
+	}
+
+	req.Header.Set(AuthHeader, "Bearer "+token)
+	return nil
+}
+
+// tokenFor returns a live access token for secret, refreshing it first if
+// it is expired or within the configured skew of expiring. Concurrent
+// calls for the same secret are single-flighted so a burst of proxied
+// requests triggers at most one token exchange.
+func (c *oidcTokenCache) tokenFor(namespace, name string, secret *corev1.Secret, credentials v1.SecretInterface) (string, error) {
+	key := namespace + "/" + name
+	skew := refreshSkew(secret)
+
+	if cached, ok := c.load(key); ok {
+		if time.Until(cached.expiry) >= skew {
+			return cached.token, nil
+		}
+	}
+
+	if !tokenExpiringSoon(secret.Data[oidcDataExpiry], skew) {
+		return string(secret.Data[oidcDataAccessToken]), nil
+	}
+
+	value, err, _ := c.group.Do(key, func() (interface{}, error) {
+		// A caller that missed the cache just before another flight for
+		// key finished would otherwise start a second exchange.
+		if cached, ok := c.load(key); ok && time.Until(cached.expiry) >= skew {
+			return cached.token, nil
+		}
+		return c.refreshAccessToken(secret, credentials)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+// refreshSkew returns how far ahead of expiry a token is refreshed,
+// reading the refresh_skew secret data key and falling back to
+// defaultTokenRefreshSkew.
+func refreshSkew(secret *corev1.Secret) time.Duration {
+	return parseDuration(secret.Data[oidcDataRefreshSkew], defaultTokenRefreshSkew)
+}
+
+func tokenExpiringSoon(expiry []byte, skew time.Duration) bool {
+	if len(expiry) == 0 {
+		return true
+	}
+	seconds, err := strconv.ParseInt(string(expiry), 10, 64)
+	if err != nil {
+		return true
+	}
+	return time.Until(time.Unix(seconds, 0)) < skew
+}
+
+type oidcDiscovery struct {
+	TokenEndpoint string `json:"token_endpoint"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// refreshAccessToken discovers the issuer's token endpoint, exchanges the
+// stored refresh token for a new access token, and persists the rotated
+// tokens back to the Secret so the next request can reuse them.
+func (c *oidcTokenCache) refreshAccessToken(secret *corev1.Secret, credentials v1.SecretInterface) (string, error) {
+	issuer := string(secret.Data[oidcDataIssuer])
+	refreshToken := string(secret.Data[oidcDataRefreshToken])
+	if issuer == "" || refreshToken == "" {
+		return "", fmt.Errorf("OIDC credential %s/%s is missing issuer or refresh_token", secret.Namespace, secret.Name)
+	}
+
+	tokenEndpoint, err := discoverTokenEndpoint(issuer)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	form.Set("client_id", string(secret.Data[oidcDataClientID]))
+	if clientSecret := string(secret.Data[oidcDataClientSecret]); clientSecret != "" {
+		form.Set("client_secret", clientSecret)
+	}
+
+	resp, err := http.PostForm(tokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("refreshing OIDC token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("refreshing OIDC token: issuer returned %v", resp.Status)
+	}
+
+	var tokenResp oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("decoding OIDC token response: %v", err)
+	}
+
+	expiry := time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+
+	// Cache the refreshed token in memory before attempting to persist it,
+	// so a failing credentials.Update still leaves tokenFor with a usable,
+	// non-expiring-soon token for this process instead of re-discovering
+	// and re-exchanging against the issuer on every subsequent request.
+	c.store(secret.Namespace+"/"+secret.Name, refreshedToken{token: tokenResp.AccessToken, expiry: expiry})
+
+	updated := secret.DeepCopy()
+	updated.Data[oidcDataAccessToken] = []byte(tokenResp.AccessToken)
+	updated.Data[oidcDataExpiry] = []byte(strconv.FormatInt(expiry.Unix(), 10))
+	if tokenResp.RefreshToken != "" {
+		updated.Data[oidcDataRefreshToken] = []byte(tokenResp.RefreshToken)
+	}
+
+	if _, err := credentials.Update(updated); err != nil {
+		logrus.Errorf("httpproxy: failed to persist refreshed OIDC token for %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+
+	return tokenResp.AccessToken, nil
+}
+
+func discoverTokenEndpoint(issuer string) (string, error) {
+	resp, err := http.Get(strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", fmt.Errorf("discovering OIDC configuration: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("discovering OIDC configuration: issuer returned %v", resp.Status)
+	}
+
+	var discovery oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return "", fmt.Errorf("decoding OIDC configuration: %v", err)
+	}
+	if discovery.TokenEndpoint == "" {
+		return "", fmt.Errorf("OIDC configuration for %s has no token_endpoint", issuer)
+	}
+
+	return discovery.TokenEndpoint, nil
+}
@@ -0,0 +1,383 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/rancher/types/apis/core/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeSecrets is a v1.SecretInterface that only implements the methods
+// oidc_signer.go actually calls. Embedding the interface itself (left
+// nil) satisfies every other method by promotion; exercising one of them
+// in a test would panic, which is exactly what we want if this file ever
+// starts relying on more of the interface than it declares here.
+type fakeSecrets struct {
+	v1.SecretInterface
+
+	getNamespaced func(namespace, name string) (*corev1.Secret, error)
+	update        func(secret *corev1.Secret) (*corev1.Secret, error)
+	updateCalls   int32
+}
+
+func (f *fakeSecrets) GetNamespaced(namespace, name string, opts metav1.GetOptions) (*corev1.Secret, error) {
+	return f.getNamespaced(namespace, name)
+}
+
+func (f *fakeSecrets) Update(secret *corev1.Secret) (*corev1.Secret, error) {
+	atomic.AddInt32(&f.updateCalls, 1)
+	return f.update(secret)
+}
+
+// fakeIssuer serves OIDC discovery and a refresh_token grant token
+// endpoint, counting how many times each is hit so tests can assert on
+// single-flighting and caching behavior.
+type fakeIssuer struct {
+	srv *httptest.Server
+
+	mu          sync.Mutex
+	tokenCalls  int
+	accessToken func(call int) string
+	expiresIn   int64
+	failToken   bool
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	issuer := &fakeIssuer{expiresIn: 3600}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(oidcDiscovery{TokenEndpoint: issuer.srv.URL + "/token"})
+	})
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, req *http.Request) {
+		issuer.mu.Lock()
+		issuer.tokenCalls++
+		call := issuer.tokenCalls
+		fail := issuer.failToken
+		issuer.mu.Unlock()
+
+		if fail {
+			http.Error(rw, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		token := fmt.Sprintf("token-%d", call)
+		if issuer.accessToken != nil {
+			token = issuer.accessToken(call)
+		}
+		json.NewEncoder(rw).Encode(oidcTokenResponse{
+			AccessToken:  token,
+			RefreshToken: "refresh-" + token,
+			ExpiresIn:    issuer.expiresIn,
+		})
+	})
+	issuer.srv = httptest.NewServer(mux)
+	t.Cleanup(issuer.srv.Close)
+	return issuer
+}
+
+func (i *fakeIssuer) calls() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.tokenCalls
+}
+
+func oidcTestSecret(namespace, name, issuer string, expiry time.Time) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Data: map[string][]byte{
+			oidcDataIssuer:       []byte(issuer),
+			oidcDataRefreshToken: []byte("initial-refresh-token"),
+			oidcDataAccessToken:  []byte("stale-access-token"),
+			oidcDataExpiry:       []byte(strconv.FormatInt(expiry.Unix(), 10)),
+		},
+	}
+}
+
+func TestRefreshAccessToken(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	secret := oidcTestSecret("cattle-system", "my-oidc", issuer.srv.URL, time.Now().Add(-time.Minute))
+
+	var updated *corev1.Secret
+	creds := &fakeSecrets{
+		update: func(s *corev1.Secret) (*corev1.Secret, error) {
+			updated = s
+			return s, nil
+		},
+	}
+
+	token, err := newOIDCTokenCache().refreshAccessToken(secret, creds)
+	if err != nil {
+		t.Fatalf("refreshAccessToken() error = %v", err)
+	}
+	if token != "token-1" {
+		t.Fatalf("token = %q, want token-1", token)
+	}
+	if updated == nil || string(updated.Data[oidcDataAccessToken]) != "token-1" {
+		t.Fatalf("persisted secret does not carry the refreshed access token: %+v", updated)
+	}
+	if string(updated.Data[oidcDataRefreshToken]) != "refresh-token-1" {
+		t.Fatalf("persisted secret does not carry the rotated refresh token: %+v", updated)
+	}
+}
+
+func TestSignFallsBackToLastKnownTokenOnRefreshFailure(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	issuer.failToken = true
+	secret := oidcTestSecret("cattle-system", "my-oidc", issuer.srv.URL, time.Now().Add(-time.Minute))
+
+	creds := &fakeSecrets{
+		getNamespaced: func(namespace, name string) (*corev1.Secret, error) {
+			return secret, nil
+		},
+		update: func(s *corev1.Secret) (*corev1.Secret, error) {
+			t.Fatalf("Update should not be called when the refresh never succeeds")
+			return nil, nil
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	signer := &oidcSigner{tokens: newOIDCTokenCache()}
+	if err := signer.sign(req, creds, "cattle-system:my-oidc:oidc"); err != nil {
+		t.Fatalf("sign() error = %v", err)
+	}
+
+	if got, want := req.Header.Get(AuthHeader), "Bearer stale-access-token"; got != want {
+		t.Fatalf("Authorization = %q, want %q", got, want)
+	}
+}
+
+func TestTokenForSingleFlightsConcurrentRefreshes(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	secret := oidcTestSecret("cattle-system", "concurrent-oidc", issuer.srv.URL, time.Now().Add(-time.Minute))
+
+	creds := &fakeSecrets{
+		update: func(s *corev1.Secret) (*corev1.Secret, error) {
+			return s, nil
+		},
+	}
+
+	cache := newOIDCTokenCache()
+
+	const n = 10
+	var wg sync.WaitGroup
+	tokens := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := cache.tokenFor(secret.Namespace, secret.Name, secret, creds)
+			if err != nil {
+				t.Errorf("tokenFor() error = %v", err)
+				return
+			}
+			tokens[i] = token
+		}(i)
+	}
+	wg.Wait()
+
+	if calls := issuer.calls(); calls != 1 {
+		t.Fatalf("issuer received %d token requests, want 1 (single-flighted)", calls)
+	}
+	for i, token := range tokens {
+		if token != tokens[0] {
+			t.Fatalf("tokens[%d] = %q, want all callers to get the same refreshed token %q", i, token, tokens[0])
+		}
+	}
+}
+
+func TestTokenForCachesAcrossPersistFailures(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	secret := oidcTestSecret("cattle-system", "unpersisted-oidc", issuer.srv.URL, time.Now().Add(-time.Minute))
+
+	creds := &fakeSecrets{
+		update: func(s *corev1.Secret) (*corev1.Secret, error) {
+			return nil, fmt.Errorf("simulated apiserver write failure")
+		},
+	}
+
+	cache := newOIDCTokenCache()
+
+	first, err := cache.tokenFor(secret.Namespace, secret.Name, secret, creds)
+	if err != nil {
+		t.Fatalf("tokenFor() error = %v", err)
+	}
+
+	// Simulate the next proxied request re-fetching the same (still-stale,
+	// since Update never persisted) secret from the API server.
+	second, err := cache.tokenFor(secret.Namespace, secret.Name, secret, creds)
+	if err != nil {
+		t.Fatalf("tokenFor() error = %v", err)
+	}
+
+	if first != second {
+		t.Fatalf("tokenFor() = %q then %q, want the in-memory cache to serve the same token both times", first, second)
+	}
+	if calls := issuer.calls(); calls != 1 {
+		t.Fatalf("issuer received %d token requests, want 1 -- a failing credentials.Update should not retrigger a refresh on every call", calls)
+	}
+}
+
+// TestOIDCTokenCacheIsolatedAcrossProxies pins down that two proxies --
+// e.g. fronting two different downstream clusters -- never share cached
+// tokens just because their OIDC credential Secrets happen to use the
+// same conventional namespace/name. Each proxy owns its own
+// oidcTokenCache (see proxy.oidcTokens), so this exercises that
+// boundary directly rather than relying on the package no longer
+// exposing a shared cache to get it right by accident.
+func TestOIDCTokenCacheIsolatedAcrossProxies(t *testing.T) {
+	issuerA := newFakeIssuer(t)
+	issuerA.accessToken = func(call int) string { return fmt.Sprintf("cluster-a-token-%d", call) }
+	issuerB := newFakeIssuer(t)
+	issuerB.accessToken = func(call int) string { return fmt.Sprintf("cluster-b-token-%d", call) }
+
+	// Same namespace/name on purpose: this is exactly the admin-reused-name
+	// scenario the cache must not conflate.
+	secretA := oidcTestSecret("cattle-system", "oidc-creds", issuerA.srv.URL, time.Now().Add(-time.Minute))
+	secretB := oidcTestSecret("cattle-system", "oidc-creds", issuerB.srv.URL, time.Now().Add(-time.Minute))
+
+	credsA := &fakeSecrets{update: func(s *corev1.Secret) (*corev1.Secret, error) { return s, nil }}
+	credsB := &fakeSecrets{update: func(s *corev1.Secret) (*corev1.Secret, error) { return s, nil }}
+
+	cacheA := newOIDCTokenCache()
+	cacheB := newOIDCTokenCache()
+
+	tokenA, err := cacheA.tokenFor(secretA.Namespace, secretA.Name, secretA, credsA)
+	if err != nil {
+		t.Fatalf("tokenFor() for cluster A error = %v", err)
+	}
+	tokenB, err := cacheB.tokenFor(secretB.Namespace, secretB.Name, secretB, credsB)
+	if err != nil {
+		t.Fatalf("tokenFor() for cluster B error = %v", err)
+	}
+
+	if tokenA == tokenB {
+		t.Fatalf("both proxies resolved to the same token %q, want cluster A and B to stay isolated", tokenA)
+	}
+	if issuerA.calls() != 1 || issuerB.calls() != 1 {
+		t.Fatalf("issuer A got %d calls, issuer B got %d calls, want 1 each -- neither issuer should see the other cluster's traffic", issuerA.calls(), issuerB.calls())
+	}
+
+	// Re-fetching for cluster B must hit cluster B's cache, not A's.
+	again, err := cacheB.tokenFor(secretB.Namespace, secretB.Name, secretB, credsB)
+	if err != nil {
+		t.Fatalf("tokenFor() for cluster B error = %v", err)
+	}
+	if again != tokenB {
+		t.Fatalf("tokenFor() for cluster B = %q, want the cached cluster B token %q", again, tokenB)
+	}
+}
+
+// TestOIDCTokenCacheEvictsIdleEntries guards against the cache growing
+// without bound over the life of a long-running proxy: an entry idle
+// past oidcTokenCacheTTL must be swept the next time store() runs its
+// periodic sweep.
+func TestOIDCTokenCacheEvictsIdleEntries(t *testing.T) {
+	cache := newOIDCTokenCache()
+	cache.entries["stale/entry"] = &oidcTokenCacheEntry{
+		token:    refreshedToken{token: "stale-token", expiry: time.Now().Add(time.Hour)},
+		lastUsed: time.Now().Add(-oidcTokenCacheTTL - time.Minute),
+	}
+	cache.entries["fresh/entry"] = &oidcTokenCacheEntry{
+		token:    refreshedToken{token: "fresh-token", expiry: time.Now().Add(time.Hour)},
+		lastUsed: time.Now(),
+	}
+
+	cache.sweepLocked(time.Now())
+
+	if _, ok := cache.entries["stale/entry"]; ok {
+		t.Fatal("sweepLocked() left a stale entry in place, want it evicted")
+	}
+	if _, ok := cache.entries["fresh/entry"]; !ok {
+		t.Fatal("sweepLocked() evicted a recently-used entry, want it kept")
+	}
+}
+
+func TestRefreshSkewConfigurableViaSecretData(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string][]byte
+		want time.Duration
+	}{
+		{
+			name: "falls back to the default when unset",
+			data: map[string][]byte{},
+			want: defaultTokenRefreshSkew,
+		},
+		{
+			name: "reads a configured duration",
+			data: map[string][]byte{oidcDataRefreshSkew: []byte("2m")},
+			want: 2 * time.Minute,
+		},
+		{
+			name: "falls back to the default on an invalid value",
+			data: map[string][]byte{oidcDataRefreshSkew: []byte("not-a-duration")},
+			want: defaultTokenRefreshSkew,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &corev1.Secret{Data: tt.data}
+			if got := refreshSkew(secret); got != tt.want {
+				t.Fatalf("refreshSkew() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenExpiringSoon(t *testing.T) {
+	skew := time.Minute
+
+	tests := []struct {
+		name   string
+		expiry []byte
+		want   bool
+	}{
+		{name: "no expiry recorded yet", expiry: nil, want: true},
+		{name: "not a number", expiry: []byte("garbage"), want: true},
+		{name: "well within validity", expiry: []byte(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)), want: false},
+		{name: "inside the skew window", expiry: []byte(strconv.FormatInt(time.Now().Add(30*time.Second).Unix(), 10)), want: true},
+		{name: "already expired", expiry: []byte(strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenExpiringSoon(tt.expiry, skew); got != tt.want {
+				t.Fatalf("tokenExpiringSoon() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverTokenEndpoint(t *testing.T) {
+	issuer := newFakeIssuer(t)
+
+	endpoint, err := discoverTokenEndpoint(issuer.srv.URL)
+	if err != nil {
+		t.Fatalf("discoverTokenEndpoint() error = %v", err)
+	}
+	if want := issuer.srv.URL + "/token"; endpoint != want {
+		t.Fatalf("discoverTokenEndpoint() = %q, want %q", endpoint, want)
+	}
+}
+
+func TestDiscoverTokenEndpointMissingField(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(oidcDiscovery{})
+	}))
+	defer srv.Close()
+
+	if _, err := discoverTokenEndpoint(srv.URL); err == nil {
+		t.Fatal("discoverTokenEndpoint() error = nil, want an error for a discovery document with no token_endpoint")
+	}
+}
@@ -2,6 +2,7 @@ package httpproxy
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -10,7 +11,6 @@ import (
 
 	v1 "github.com/rancher/types/apis/core/v1"
 	"github.com/rancher/types/config"
-	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -29,6 +29,7 @@ var (
 	httpsStart = regexp.MustCompile("^https:/([^/])")
 	badHeaders = map[string]bool{
 		"host":                    true,
+		"connection":              true,
 		"transfer-encoding":       true,
 		"content-length":          true,
 		"x-api-auth-header":       true,
@@ -46,40 +47,85 @@ type proxy struct {
 	prefix             string
 	validHostsSupplier Supplier
 	credentials        v1.SecretInterface
+	transports         *transportCache
+	policies           hostPolicyCache
+	middlewares        []Middleware
+
+	// oidcTokens caches refreshed OIDC access tokens for this proxy's
+	// credentials client. Scoped per-proxy, not shared package-wide,
+	// because two proxies can front different clusters whose OIDC
+	// credential Secrets happen to share a namespace/name -- a shared
+	// cache would leak one cluster's bearer token into the other's
+	// requests.
+	oidcTokens *oidcTokenCache
+
+	// resolveHost is overridden in tests; defaults to net.LookupIP.
+	resolveHost func(host string) ([]net.IP, error)
 }
 
-func (p *proxy) isAllowed(host string) bool {
-	for _, valid := range p.validHostsSupplier() {
-		if valid == host {
-			return true
-		}
-
-		if strings.HasPrefix(valid, "*") && strings.HasSuffix(host, valid[1:]) {
-			return true
-		}
-	}
-
-	return false
+// policy returns the compiled HostPolicy for the current validHosts
+// snapshot, recompiling only when the snapshot has changed.
+func (p *proxy) policy() *HostPolicy {
+	return p.policies.get(p.validHostsSupplier())
 }
 
-func NewProxy(prefix string, validHosts Supplier, scaledContext *config.ScaledContext) http.Handler {
+func NewProxy(prefix string, validHosts Supplier, scaledContext *config.ScaledContext, opts ...Option) http.Handler {
+	credentials := scaledContext.Core.Secrets("")
 	p := proxy{
 		prefix:             prefix,
 		validHostsSupplier: validHosts,
-		credentials:        scaledContext.Core.Secrets(""),
+		credentials:        credentials,
+		transports:         newTransportCache(credentials),
+		oidcTokens:         newOIDCTokenCache(),
+		resolveHost:        net.LookupIP,
 	}
 
-	return &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			if err := p.proxy(req); err != nil {
-				logrus.Infof("Failed to proxy %v: %v", req, err)
-			}
-		},
+	for _, opt := range opts {
+		opt(&p)
+	}
+
+	reverseProxy := &httputil.ReverseProxy{
+		// middlewareHandler already resolved req to its outbound form (and
+		// ran the After chain) before handing off to ReverseProxy, so
+		// there's nothing left for Director to do -- but ReverseProxy
+		// requires one.
+		Director:       func(req *http.Request) {},
 		ModifyResponse: replaceSetCookies,
+		Transport:      &hostRoundTripper{proxy: &p},
+		// Streamed and upgraded responses (SSE, WebSocket) must reach the
+		// client as they arrive rather than waiting on Go's default
+		// buffering interval.
+		FlushInterval: -1,
 	}
+
+	return &middlewareHandler{proxy: &p, next: reverseProxy}
+}
+
+// hostRoundTripper picks the transport for the outbound request's
+// (already rewritten by proxy()) destination host, so each upstream can be
+// trusted with its own CA bundle and client certificate.
+type hostRoundTripper struct {
+	proxy *proxy
+}
+
+func (rt *hostRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, secretRef := rt.proxy.policy().Allowed(req.URL)
+
+	transport, err := rt.proxy.transports.forHost(req.URL.Host, secretRef)
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
 }
 
 func replaceSetCookies(res *http.Response) error {
+	// httputil.ReverseProxy runs ModifyResponse on 101 responses too,
+	// before it hijacks the connection; skip them so cookie headers aren't
+	// rewritten on a connection that's about to become a raw byte stream.
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+
 	res.Header.Del(APISetCookie)
 	// There may be multiple set cookies
 	for _, setCookie := range res.Header[SetCookie] {
@@ -109,10 +155,16 @@ func (p *proxy) proxy(req *http.Request) error {
 
 	destURL.RawQuery = req.URL.RawQuery
 
-	if !p.isAllowed(destURL.Host) {
+	if allowed, _ := p.policy().Allowed(destURL); !allowed {
 		return fmt.Errorf("invalid host: %v", destURL.Host)
 	}
 
+	if err := p.checkSSRF(req, destURL.Hostname()); err != nil {
+		return err
+	}
+
+	setDestination(req, destURL.Host, destURL.Path)
+
 	headerCopy := http.Header{}
 
 	if req.TLS != nil {
@@ -120,8 +172,9 @@ func (p *proxy) proxy(req *http.Request) error {
 	}
 	auth := req.Header.Get(APIAuth)
 	cAuth := req.Header.Get(CattleAuth)
+	upgrade := isUpgradeRequest(req)
 	for name, value := range req.Header {
-		if badHeaders[strings.ToLower(name)] {
+		if badHeaders[strings.ToLower(name)] && !(upgrade && isUpgradeHeader(name)) {
 			continue
 		}
 
@@ -141,15 +194,52 @@ func (p *proxy) proxy(req *http.Request) error {
 	} else if cAuth != "" {
 		// setting CattleAuthHeader will replace credential id with secret data
 		// and generate signature
-		signer := newSigner(cAuth)
+		signer := newSigner(cAuth, p.oidcTokens)
 		if signer != nil {
-			return signer.sign(req, p.credentials, cAuth)
+			if err := signer.sign(req, p.credentials, cAuth); err != nil {
+				return err
+			}
+		} else {
+			req.Header.Set(AuthHeader, cAuth)
 		}
-		req.Header.Set(AuthHeader, cAuth)
 	}
 
 	replaceCookies(req)
 
+	return p.runAfter(req)
+}
+
+// checkSSRF resolves host and rejects the request if any resolved
+// address falls in private/link-local/loopback space without an
+// explicit CIDR literal in validHosts allowing it. A host pattern like
+// "*.compute.amazonaws.com" should not be enough, on its own, to tunnel
+// into RFC1918 space.
+//
+// The validated address(es) are pinned onto req's context so the
+// transport dials them directly instead of re-resolving host, closing
+// the DNS-rebinding gap where a short-TTL record answers a public
+// address here and a private one at connect time.
+func (p *proxy) checkSSRF(req *http.Request, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !p.policy().AllowedAddr(ip) {
+			return fmt.Errorf("invalid host: %v resolves to disallowed address", host)
+		}
+		pinResolvedAddrs(req, []net.IP{ip})
+		return nil
+	}
+
+	addrs, err := p.resolveHost(host)
+	if err != nil {
+		return fmt.Errorf("resolving host %v: %v", host, err)
+	}
+
+	for _, addr := range addrs {
+		if !p.policy().AllowedAddr(addr) {
+			return fmt.Errorf("invalid host: %v resolves to disallowed address %v", host, addr)
+		}
+	}
+
+	pinResolvedAddrs(req, addrs)
 	return nil
 }
 
@@ -0,0 +1,206 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/rancher/types/apis/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultReceiveTimeout = 30 * time.Second
+
+	secretDataCA          = "ca.crt"
+	secretDataCert        = "tls.crt"
+	secretDataKey         = "tls.key"
+	secretDataConnectTime = "connect-timeout"
+	secretDataReceiveTime = "receive-timeout"
+)
+
+// tlsProfile is the cached transport built from a TLS profile secret,
+// tagged with the secret's resourceVersion so we know when to rebuild it.
+type tlsProfile struct {
+	resourceVersion string
+	transport       *http.Transport
+}
+
+// transportCache builds and caches an *http.Transport per per-host TLS
+// profile secret, keyed by host and invalidated whenever the backing
+// secret's resourceVersion changes.
+type transportCache struct {
+	mu      sync.RWMutex
+	entries map[string]*tlsProfile
+
+	credentials      v1.SecretInterface
+	defaultTransport *http.Transport
+}
+
+func newTransportCache(credentials v1.SecretInterface) *transportCache {
+	return &transportCache{
+		entries:          map[string]*tlsProfile{},
+		credentials:      credentials,
+		defaultTransport: buildTransport(&net.Dialer{Timeout: defaultConnectTimeout}, nil, defaultReceiveTimeout),
+	}
+}
+
+// forHost returns the transport to use for host. secretRef, if non-empty,
+// names the TLS profile secret ("namespace:name") configured for the
+// matching validHosts entry; an empty secretRef falls back to the shared
+// default transport. Both transports dial the address(es) already
+// validated and pinned by checkSSRF, rather than re-resolving host, so a
+// short-TTL DNS record can't rebind between the policy check and the
+// actual connection.
+func (c *transportCache) forHost(host, secretRef string) (*http.Transport, error) {
+	if secretRef == "" {
+		return c.defaultTransport, nil
+	}
+
+	namespace, name, err := splitSecretRef(secretRef)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := c.credentials.GetNamespaced(namespace, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("looking up TLS profile secret %s: %v", secretRef, err)
+	}
+
+	c.mu.RLock()
+	cached, ok := c.entries[host]
+	c.mu.RUnlock()
+	if ok && cached.resourceVersion == secret.ResourceVersion {
+		return cached.transport, nil
+	}
+
+	transport, err := transportFromSecretData(secret.Data)
+	if err != nil {
+		return nil, fmt.Errorf("building TLS profile transport for %s: %v", secretRef, err)
+	}
+
+	c.mu.Lock()
+	c.entries[host] = &tlsProfile{
+		resourceVersion: secret.ResourceVersion,
+		transport:       transport,
+	}
+	c.mu.Unlock()
+
+	return transport, nil
+}
+
+func splitSecretRef(ref string) (namespace, name string, err error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid secret reference %q, expected namespace:name", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+func parseDuration(raw []byte, def time.Duration) time.Duration {
+	if len(raw) == 0 {
+		return def
+	}
+	d, err := time.ParseDuration(string(raw))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+func tlsConfigFromSecret(data map[string][]byte) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if ca := data[secretDataCA]; len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no valid certificates found in %s", secretDataCA)
+		}
+		config.RootCAs = pool
+	}
+
+	cert, hasCert := data[secretDataCert]
+	key, hasKey := data[secretDataKey]
+	if len(cert) > 0 && len(key) > 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("loading client cert/key: %v", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	} else if hasCert != hasKey {
+		return nil, fmt.Errorf("%s and %s must both be set for mTLS", secretDataCert, secretDataKey)
+	}
+
+	return config, nil
+}
+
+func transportFromSecretData(data map[string][]byte) (*http.Transport, error) {
+	tlsConfig, err := tlsConfigFromSecret(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: parseDuration(data[secretDataConnectTime], defaultConnectTimeout)}
+	receiveTimeout := parseDuration(data[secretDataReceiveTime], defaultReceiveTimeout)
+
+	return buildTransport(dialer, tlsConfig, receiveTimeout), nil
+}
+
+func buildTransport(dialer *net.Dialer, tlsConfig *tls.Config, receiveTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           pinnedDialContext(dialer),
+		TLSClientConfig:       tlsConfig,
+		ResponseHeaderTimeout: receiveTimeout,
+	}
+}
+
+// resolvedAddrsKey is the context key checkSSRF uses to pin the dial to
+// the address(es) it already validated against the host policy.
+type resolvedAddrsKey struct{}
+
+// pinResolvedAddrs records the addresses checkSSRF validated for req's
+// destination host, so the eventual dial reuses them instead of
+// re-resolving DNS (which a DNS-rebinding attacker could answer
+// differently the second time). req.WithContext returns a new *Request,
+// so this mutates *req in place: middlewareHandler keeps using the same
+// *Request and hands it to ReverseProxy, whose outbound copy (and so the
+// RoundTripper) inherits the pinned context.
+func pinResolvedAddrs(req *http.Request, addrs []net.IP) {
+	*req = *req.WithContext(context.WithValue(req.Context(), resolvedAddrsKey{}, addrs))
+}
+
+// pinnedDialContext dials the address(es) pinned on the context by
+// checkSSRF, if any, instead of letting the dialer re-resolve addr's
+// host itself. Falls back to a plain dial when nothing was pinned (e.g.
+// SSRF checking is bypassed in a test, or the context was stripped).
+func pinnedDialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addrs, _ := ctx.Value(resolvedAddrsKey{}).([]net.IP)
+		if len(addrs) == 0 {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, ip := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, fmt.Errorf("dialing %s (pinned to %v): %v", addr, addrs, lastErr)
+	}
+}
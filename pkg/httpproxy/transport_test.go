@@ -0,0 +1,124 @@
+package httpproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// generateTestCertKeyPEM returns a self-signed certificate and its private
+// key, PEM-encoded, for exercising tlsConfigFromSecret's cert/key loading.
+func generateTestCertKeyPEM(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshalling key: %v", err)
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM
+}
+
+func TestTlsConfigFromSecretCAOnly(t *testing.T) {
+	caPEM, _ := generateTestCertKeyPEM(t)
+
+	config, err := tlsConfigFromSecret(map[string][]byte{secretDataCA: caPEM})
+	if err != nil {
+		t.Fatalf("tlsConfigFromSecret returned error: %v", err)
+	}
+	if config.RootCAs == nil {
+		t.Fatal("RootCAs was not populated from ca.crt")
+	}
+	if len(config.Certificates) != 0 {
+		t.Fatalf("Certificates = %v, want none for a CA-only secret", config.Certificates)
+	}
+}
+
+func TestTlsConfigFromSecretCertKeyPair(t *testing.T) {
+	certPEM, keyPEM := generateTestCertKeyPEM(t)
+
+	config, err := tlsConfigFromSecret(map[string][]byte{
+		secretDataCert: certPEM,
+		secretDataKey:  keyPEM,
+	})
+	if err != nil {
+		t.Fatalf("tlsConfigFromSecret returned error: %v", err)
+	}
+	if len(config.Certificates) != 1 {
+		t.Fatalf("Certificates = %v, want exactly one client certificate", config.Certificates)
+	}
+}
+
+func TestTlsConfigFromSecretCertWithoutKeyErrors(t *testing.T) {
+	certPEM, _ := generateTestCertKeyPEM(t)
+
+	_, err := tlsConfigFromSecret(map[string][]byte{secretDataCert: certPEM})
+	if err == nil {
+		t.Fatal("expected an error for tls.crt without tls.key, got nil")
+	}
+}
+
+func TestTransportCacheForHostRebuildsOnResourceVersionChange(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"},
+		Data:       map[string][]byte{},
+	}
+
+	creds := &fakeSecrets{
+		getNamespaced: func(namespace, name string) (*corev1.Secret, error) {
+			return secret, nil
+		},
+	}
+	cache := newTransportCache(creds)
+
+	first, err := cache.forHost("example.com", "ns:profile")
+	if err != nil {
+		t.Fatalf("forHost returned error: %v", err)
+	}
+
+	again, err := cache.forHost("example.com", "ns:profile")
+	if err != nil {
+		t.Fatalf("forHost returned error: %v", err)
+	}
+	if again != first {
+		t.Fatal("forHost rebuilt the transport even though resourceVersion did not change")
+	}
+
+	secret.ResourceVersion = "2"
+	rebuilt, err := cache.forHost("example.com", "ns:profile")
+	if err != nil {
+		t.Fatalf("forHost returned error: %v", err)
+	}
+	if rebuilt == first {
+		t.Fatal("forHost reused the cached transport after resourceVersion changed")
+	}
+}
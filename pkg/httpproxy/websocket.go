@@ -0,0 +1,42 @@
+package httpproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// upgradeHeaderPrefixes are the headers a WebSocket (or other protocol
+// upgrade) handshake needs verbatim. Of these, only Connection is in
+// badHeaders; it is kept instead of stripped on upgrade requests.
+var upgradeHeaderPrefixes = []string{
+	"connection",
+	"upgrade",
+	"sec-websocket-",
+}
+
+// isUpgradeRequest reports whether req is asking to switch protocols,
+// e.g. a WebSocket handshake ("Connection: Upgrade", "Upgrade: websocket").
+func isUpgradeRequest(req *http.Request) bool {
+	return headerTokenContains(req.Header.Get("Connection"), "upgrade")
+}
+
+// isUpgradeHeader reports whether name is one of the headers that must be
+// preserved on an upgrade request/response regardless of badHeaders.
+func isUpgradeHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, prefix := range upgradeHeaderPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func headerTokenContains(header, token string) bool {
+	for _, part := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
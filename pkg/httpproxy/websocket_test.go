@@ -0,0 +1,70 @@
+package httpproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderTokenContains(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		want   bool
+	}{
+		{"Upgrade", "upgrade", true},
+		{"keep-alive, Upgrade", "upgrade", true},
+		{"Upgrade,keep-alive", "upgrade", true},
+		{" Upgrade ", "upgrade", true},
+		{"keep-alive", "upgrade", false},
+		{"", "upgrade", false},
+	}
+
+	for _, tt := range tests {
+		if got := headerTokenContains(tt.header, tt.token); got != tt.want {
+			t.Errorf("headerTokenContains(%q, %q) = %v, want %v", tt.header, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if isUpgradeRequest(req) {
+		t.Fatal("request with no Connection header should not be an upgrade request")
+	}
+
+	req.Header.Set("Connection", "keep-alive")
+	if isUpgradeRequest(req) {
+		t.Fatal("Connection: keep-alive should not be an upgrade request")
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	if !isUpgradeRequest(req) {
+		t.Fatal("Connection: Upgrade should be an upgrade request")
+	}
+
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	if !isUpgradeRequest(req) {
+		t.Fatal("Connection: keep-alive, Upgrade should be an upgrade request")
+	}
+}
+
+func TestIsUpgradeHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Connection", true},
+		{"connection", true},
+		{"Upgrade", true},
+		{"Sec-WebSocket-Key", true},
+		{"Sec-WebSocket-Version", true},
+		{"Content-Length", false},
+		{"Authorization", false},
+	}
+
+	for _, tt := range tests {
+		if got := isUpgradeHeader(tt.name); got != tt.want {
+			t.Errorf("isUpgradeHeader(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}